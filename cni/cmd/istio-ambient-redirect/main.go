@@ -0,0 +1,173 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command istio-ambient-redirect is a CNI chained plugin. When listed after a primary
+// CNI plugin (Calico, Cilium, Flannel, ...) in a network's plugin chain, it reads that
+// plugin's PrevResult to learn the pod's host-side ifindex, MAC and IP addresses, then
+// forwards an equivalent server.RedirectArgs to a running ztunnel-cni RedirectServer
+// over a unix socket. This lets ambient redirection be composed onto any CNI plugin
+// instead of being embedded into the node agent's own pod lifecycle handling.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
+
+	"istio.io/istio/cni/pkg/ebpf/server"
+)
+
+// pluginConf is the CNI network configuration passed to this plugin. PrevResult is
+// filled in by the CNI runtime because this plugin is always chained after a primary
+// one.
+type pluginConf struct {
+	types.NetConf
+	// SocketPath overrides server.DefaultIPCSocket, mainly useful in tests.
+	SocketPath string `json:"socketPath,omitempty"`
+}
+
+func parseConf(data []byte) (*pluginConf, error) {
+	conf := pluginConf{SocketPath: server.DefaultIPCSocket}
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return nil, fmt.Errorf("failed to parse network configuration: %w", err)
+	}
+	if err := version.ParsePrevResult(&conf.NetConf); err != nil {
+		return nil, fmt.Errorf("failed to parse prevResult: %w", err)
+	}
+	return &conf, nil
+}
+
+// redirectArgsFromPrevResult builds a server.RedirectArgs describing the pod interface
+// that the primary CNI plugin just created, by pairing the host-side interface (empty
+// Sandbox) with the IP addresses the result attributes to the pod-side interface. It
+// errors if prevResult reports more than one host-side interface, since there would be
+// no way to tell which one actually belongs to this pod.
+func redirectArgsFromPrevResult(conf *pluginConf, remove bool) (*server.RedirectArgs, error) {
+	prevResult, err := current.GetResult(conf.PrevResult)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert prevResult: %w", err)
+	}
+
+	args := &server.RedirectArgs{Remove: remove}
+	podIfaceIdx := -1
+	hostIfaceFound := false
+	for i, iface := range prevResult.Interfaces {
+		if iface.Sandbox != "" {
+			podIfaceIdx = i
+			continue
+		}
+		if hostIfaceFound {
+			return nil, fmt.Errorf("prevResult has more than one host-side interface, cannot tell which to redirect")
+		}
+		hostIfaceFound = true
+		if mac, err := net.ParseMAC(iface.Mac); err == nil {
+			args.MacAddr = mac
+		}
+		if hostIface, err := net.InterfaceByName(iface.Name); err == nil {
+			args.Ifindex = hostIface.Index
+		}
+	}
+	if podIfaceIdx == -1 {
+		return nil, fmt.Errorf("no pod-side interface found in prevResult")
+	}
+
+	for _, ipConfig := range prevResult.IPs {
+		if ipConfig.Interface == nil || *ipConfig.Interface != podIfaceIdx {
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(ipConfig.Address.IP)
+		if !ok {
+			continue
+		}
+		args.IPAddrs = append(args.IPAddrs, addr.Unmap())
+	}
+	if len(args.IPAddrs) == 0 {
+		return nil, fmt.Errorf("no pod IP addresses found in prevResult")
+	}
+
+	return args, nil
+}
+
+func sendToServer(socketPath string, args *server.RedirectArgs) error {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to reach redirect server at %s: %w", socketPath, err)
+	}
+	defer conn.Close()
+
+	req := struct {
+		Args *server.RedirectArgs `json:"args"`
+	}{Args: args}
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return fmt.Errorf("failed to send redirect request: %w", err)
+	}
+
+	resp := struct {
+		Error string `json:"error,omitempty"`
+	}{}
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return fmt.Errorf("failed to read redirect server response: %w", err)
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("redirect server rejected request: %s", resp.Error)
+	}
+	return nil
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	conf, err := parseConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	redirectArgs, err := redirectArgsFromPrevResult(conf, false)
+	if err != nil {
+		return err
+	}
+	if err := sendToServer(conf.SocketPath, redirectArgs); err != nil {
+		return err
+	}
+
+	// this plugin only observes the chain's result, it doesn't modify it
+	return types.PrintResult(conf.PrevResult, conf.CNIVersion)
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	conf, err := parseConf(args.StdinData)
+	if err != nil {
+		// a missing/invalid prevResult on delete most likely means the primary plugin
+		// already tore the interface down; there's nothing left for us to clean up
+		return nil
+	}
+
+	redirectArgs, err := redirectArgsFromPrevResult(conf, true)
+	if err != nil {
+		return nil
+	}
+	return sendToServer(conf.SocketPath, redirectArgs)
+}
+
+func cmdCheck(_ *skel.CmdArgs) error {
+	return nil
+}
+
+func main() {
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, "istio-ambient-redirect CNI plugin")
+}
@@ -0,0 +1,139 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+
+	"istio.io/istio/cni/pkg/ebpf/server"
+)
+
+func TestParseConf(t *testing.T) {
+	cases := []struct {
+		name       string
+		data       string
+		wantSocket string
+		wantErr    bool
+	}{
+		{
+			name:       "defaults socket path",
+			data:       `{"cniVersion":"1.0.0","name":"test","type":"istio-ambient-redirect"}`,
+			wantSocket: server.DefaultIPCSocket,
+		},
+		{
+			name:       "socket path override",
+			data:       `{"cniVersion":"1.0.0","name":"test","type":"istio-ambient-redirect","socketPath":"/tmp/custom.sock"}`,
+			wantSocket: "/tmp/custom.sock",
+		},
+		{
+			name:    "invalid json",
+			data:    `{`,
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			conf, err := parseConf([]byte(tc.data))
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("parseConf(%q) expected error, got nil", tc.data)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseConf(%q) unexpected error: %v", tc.data, err)
+			}
+			if conf.SocketPath != tc.wantSocket {
+				t.Errorf("SocketPath = %q, want %q", conf.SocketPath, tc.wantSocket)
+			}
+		})
+	}
+}
+
+func TestRedirectArgsFromPrevResult(t *testing.T) {
+	podIfaceIdx := 0
+
+	mkConf := func(ifaces []*current.Interface, ips []*current.IPConfig) *pluginConf {
+		return &pluginConf{
+			NetConf: types.NetConf{
+				PrevResult: &current.Result{
+					CNIVersion: "1.0.0",
+					Interfaces: ifaces,
+					IPs:        ips,
+				},
+			},
+		}
+	}
+
+	t.Run("pairs host interface with pod IPs", func(t *testing.T) {
+		conf := mkConf(
+			[]*current.Interface{
+				{Name: "eth0", Sandbox: "/proc/1234/ns/net"},
+				{Name: "lo", Mac: "02:00:00:00:00:01"},
+			},
+			[]*current.IPConfig{
+				{Interface: &podIfaceIdx, Address: net.IPNet{IP: net.ParseIP("10.0.0.5"), Mask: net.CIDRMask(32, 32)}},
+			},
+		)
+		args, err := redirectArgsFromPrevResult(conf, false)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if args.Remove {
+			t.Errorf("Remove = true, want false")
+		}
+		if len(args.IPAddrs) != 1 || args.IPAddrs[0].String() != "10.0.0.5" {
+			t.Errorf("IPAddrs = %v, want [10.0.0.5]", args.IPAddrs)
+		}
+		if args.MacAddr.String() != "02:00:00:00:00:01" {
+			t.Errorf("MacAddr = %v, want 02:00:00:00:00:01", args.MacAddr)
+		}
+	})
+
+	t.Run("errors on no pod interface", func(t *testing.T) {
+		conf := mkConf([]*current.Interface{{Name: "lo"}}, nil)
+		if _, err := redirectArgsFromPrevResult(conf, false); err == nil {
+			t.Fatal("expected error for missing pod-side interface")
+		}
+	})
+
+	t.Run("errors on no pod IPs", func(t *testing.T) {
+		conf := mkConf([]*current.Interface{
+			{Name: "eth0", Sandbox: "/proc/1234/ns/net"},
+			{Name: "lo"},
+		}, nil)
+		if _, err := redirectArgsFromPrevResult(conf, false); err == nil {
+			t.Fatal("expected error for missing pod IPs")
+		}
+	})
+
+	t.Run("errors on ambiguous host interface", func(t *testing.T) {
+		conf := mkConf([]*current.Interface{
+			{Name: "eth0", Sandbox: "/proc/1234/ns/net"},
+			{Name: "lo"},
+			{Name: "lo"},
+		}, []*current.IPConfig{
+			{Interface: &podIfaceIdx, Address: net.IPNet{IP: net.ParseIP("10.0.0.5"), Mask: net.CIDRMask(32, 32)}},
+		})
+		if _, err := redirectArgsFromPrevResult(conf, false); err == nil {
+			t.Fatal("expected error for ambiguous host-side interface")
+		}
+	})
+}
@@ -0,0 +1,47 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net"
+	"net/netip"
+)
+
+// RedirectArgs describes a single AddPodToMesh/handleRequest: either enroll
+// (Remove=false) or unenroll (Remove=true) a workload's or ztunnel's interface(s) for
+// ambient redirection. It is the payload carried both by the in-process
+// redirectArgsChan (AcceptRequest) and by the unix-socket IPC listener (ServeIPC) used
+// by the istio-ambient-redirect CNI plugin.
+type RedirectArgs struct {
+	// IPAddrs is every IPv4 and IPv6 address owned by the workload being (un)enrolled.
+	IPAddrs []netip.Addr `json:"ipAddrs"`
+	// MacAddr is the workload's host-veth MAC address.
+	MacAddr net.HardwareAddr `json:"macAddr"`
+	// Ifindex is the host-side ifindex of the workload's veth.
+	Ifindex int `json:"ifindex"`
+	// PeerIndex is the ifindex of the matching veth end inside PeerNs. Only meaningful
+	// when IsZtunnel is true.
+	PeerIndex int `json:"peerIndex"`
+	// PeerNs is the network namespace holding PeerIndex. Only meaningful when
+	// IsZtunnel is true.
+	PeerNs string `json:"peerNs"`
+	// IsZtunnel is true when this request is (un)enrolling the node's local ztunnel
+	// rather than a regular mesh workload.
+	IsZtunnel bool `json:"isZtunnel"`
+	// CaptureDNS requests that DNS traffic from this workload be redirected to ztunnel.
+	CaptureDNS bool `json:"captureDns"`
+	// Remove tears down a previously applied request instead of applying a new one.
+	Remove bool `json:"remove"`
+}
@@ -0,0 +1,102 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// DefaultIPCSocket is where RedirectServer listens for RedirectArgs forwarded by the
+// istio-ambient-redirect CNI plugin, so ambient redirection can be driven by a chained
+// CNI plugin process instead of only by the in-process redirectArgsChan.
+const DefaultIPCSocket = "/var/run/istio-cni/redirect-server.sock"
+
+// ipcRequest is the wire format sent by the istio-ambient-redirect CNI plugin.
+type ipcRequest struct {
+	Args *RedirectArgs `json:"args"`
+}
+
+// ipcResponse is the wire format returned for every ipcRequest.
+type ipcResponse struct {
+	Error string `json:"error,omitempty"`
+}
+
+// ServeIPC listens on a unix socket at socketPath and, for each connection, decodes a
+// single ipcRequest, applies it via handleRequest and writes back an ipcResponse. The
+// listener is closed when stop is closed.
+func (r *RedirectServer) ServeIPC(socketPath string, stop <-chan struct{}) error {
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0o755); err != nil {
+		return fmt.Errorf("unable to create IPC socket directory: %v", err)
+	}
+	if err := os.RemoveAll(socketPath); err != nil {
+		return fmt.Errorf("unable to remove stale IPC socket: %v", err)
+	}
+
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("unable to listen on IPC socket %s: %v", socketPath, err)
+	}
+
+	go func() {
+		<-stop
+		if err := l.Close(); err != nil {
+			log.Warnf("failed to close IPC listener on %s: %v", socketPath, err)
+		}
+	}()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				log.Debugf("IPC listener on %s stopped accepting connections: %v", socketPath, err)
+				return
+			}
+			go r.handleIPCConn(conn)
+		}
+	}()
+
+	return nil
+}
+
+func (r *RedirectServer) handleIPCConn(conn net.Conn) {
+	defer conn.Close()
+
+	var req ipcRequest
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		log.Errorf("failed to decode IPC request: %v", err)
+		r.writeIPCResponse(conn, fmt.Errorf("malformed request: %w", err))
+		return
+	}
+	if req.Args == nil {
+		r.writeIPCResponse(conn, fmt.Errorf("malformed request: missing args"))
+		return
+	}
+
+	r.writeIPCResponse(conn, r.handleRequest(req.Args))
+}
+
+func (r *RedirectServer) writeIPCResponse(conn net.Conn, handleErr error) {
+	resp := ipcResponse{}
+	if handleErr != nil {
+		resp.Error = handleErr.Error()
+	}
+	if err := json.NewEncoder(conn).Encode(resp); err != nil {
+		log.Errorf("failed to write IPC response: %v", err)
+	}
+}
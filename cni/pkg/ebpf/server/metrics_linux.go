@@ -0,0 +1,89 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// EventMetrics holds the Prometheus collectors fed by the ambient redirect datapath's
+// event ring buffer. It is created once by StartEventConsumer and exposed as
+// RedirectServer.Metrics so callers can register its Registry with their own HTTP
+// handler.
+type EventMetrics struct {
+	Registry *prometheus.Registry
+
+	// PacketsTotal counts every redirect_event observed, labeled by the tc program
+	// that emitted it and the verdict (TC_ACT_*) it carried.
+	PacketsTotal *prometheus.CounterVec
+	// DNSCaptureLatency observes, for events flagged is_dns, the delay between the
+	// datapath recording the event and the agent consuming it off the ring buffer.
+	DNSCaptureLatency prometheus.Histogram
+}
+
+func newEventMetrics() *EventMetrics {
+	packetsTotal := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "istio_ambient_redirect_packets_total",
+		Help: "Total packets observed by the ambient redirect eBPF datapath, by program and verdict.",
+	}, []string{"prog", "verdict"})
+
+	dnsCaptureLatency := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "istio_ambient_redirect_dns_capture_latency_seconds",
+		Help:    "Delay between a DNS-capture verdict being recorded in the datapath and observed by the agent.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(packetsTotal, dnsCaptureLatency)
+
+	return &EventMetrics{
+		Registry:          registry,
+		PacketsTotal:      packetsTotal,
+		DNSCaptureLatency: dnsCaptureLatency,
+	}
+}
+
+func verdictLabel(verdict uint8) string {
+	switch int32(int8(verdict)) {
+	case tcActOK:
+		return "TC_ACT_OK"
+	case tcActShot:
+		return "TC_ACT_SHOT"
+	case tcActRedirect:
+		return "TC_ACT_REDIRECT"
+	default:
+		return "unknown"
+	}
+}
+
+// refer to include/uapi/linux/pkt_cls.h
+const (
+	tcActOK       = 0
+	tcActShot     = 2
+	tcActRedirect = 7
+)
+
+func progIDLabel(progID uint32) string {
+	switch progID {
+	case 1:
+		return "app_inbound"
+	case 2:
+		return "app_outbound"
+	case 3:
+		return "ztunnel_ingress"
+	case 4:
+		return "ztunnel_host_ingress"
+	default:
+		return "unknown"
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import "testing"
+
+func TestProgIDLabel(t *testing.T) {
+	cases := []struct {
+		progID uint32
+		want   string
+	}{
+		{1, "app_inbound"},
+		{2, "app_outbound"},
+		{3, "ztunnel_ingress"},
+		{4, "ztunnel_host_ingress"},
+		{0, "unknown"},
+		{99, "unknown"},
+	}
+
+	for _, tc := range cases {
+		if got := progIDLabel(tc.progID); got != tc.want {
+			t.Errorf("progIDLabel(%d) = %q, want %q", tc.progID, got, tc.want)
+		}
+	}
+}
+
+func TestVerdictLabel(t *testing.T) {
+	cases := []struct {
+		verdict uint8
+		want    string
+	}{
+		{tcActOK, "TC_ACT_OK"},
+		{tcActShot, "TC_ACT_SHOT"},
+		{tcActRedirect, "TC_ACT_REDIRECT"},
+		{255, "unknown"},
+	}
+
+	for _, tc := range cases {
+		if got := verdictLabel(tc.verdict); got != tc.want {
+			t.Errorf("verdictLabel(%d) = %q, want %q", tc.verdict, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,308 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/cilium/ebpf"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/hashicorp/go-multierror"
+
+	"istio.io/istio/pkg/util/istiomultierror"
+)
+
+const netnsDir = "/var/run/netns"
+
+// expectedAttachment is one (program, direction) pair that AppInfo4/AppInfo6/
+// ZtunnelInfo says should be attached on a given ifindex, used by reconcileExpected to
+// notice an attachment that is missing entirely rather than merely stale.
+type expectedAttachment struct {
+	dir  TCFilterDir
+	prog *ebpf.Program
+	fd   uint32
+	name string
+}
+
+// Reconcile is run once on ztunnel-cni startup, after initBpfObjects has (re)loaded and
+// pinned the ambient_redirect programs/maps. A crash or upgrade of the agent leaves the
+// pinned maps in place but can leave attachment state out of sync with them: legacy
+// netlink filters pointing at a program FD that no longer exists, TCX bpf_links missing
+// entirely for an ifindex that AppInfo/ZtunnelInfo still references, or
+// AppInfo/ZtunnelInfo entries for interfaces that disappeared while the agent was down.
+// Reconcile walks the host namespace and every namespace under /var/run/netns, repairs
+// both attachment paths, and prunes those stale map entries.
+func (r *RedirectServer) Reconcile() error {
+	multiErr := istiomultierror.New()
+
+	hostExpected, peerNs, peerExpected, err := r.expectedAttachments()
+	if err != nil {
+		multiErr = multierror.Append(multiErr, err)
+	}
+
+	if err := r.reconcileNetNS("", hostExpected); err != nil {
+		multiErr = multierror.Append(multiErr, err)
+	}
+
+	entries, err := os.ReadDir(netnsDir)
+	if err != nil && !os.IsNotExist(err) {
+		multiErr = multierror.Append(multiErr, fmt.Errorf("failed to list %s: %w", netnsDir, err))
+	}
+	for _, e := range entries {
+		nsPath := filepath.Join(netnsDir, e.Name())
+		// hostExpected is keyed by the host-side veth ifindex recorded in
+		// AppInfo/ZtunnelInfo (see args_linux.go); ifindex numbering is local to each
+		// network namespace, so reusing it against a pod's own interfaces here would
+		// risk matching an unrelated pod's ifindex by coincidence. The one exception is
+		// ztunnel_ingress, which attachTCForZtunnel attaches inside ztunnel's own
+		// namespace (ZtunnelInfo.PeerNs) rather than the host's — peerExpected is only
+		// non-nil for that single namespace, identified by name rather than ifindex.
+		var nsExpected map[uint32][]expectedAttachment
+		if peerNs != "" && e.Name() == peerNs {
+			nsExpected = peerExpected
+		}
+		if err := ns.WithNetNSPath(nsPath, func(ns.NetNS) error {
+			return r.reconcileNetNS(nsPath, nsExpected)
+		}); err != nil {
+			multiErr = multierror.Append(multiErr, fmt.Errorf("failed to reconcile netns %s: %w", nsPath, err))
+		}
+	}
+
+	if err := r.pruneStaleAppInfo(); err != nil {
+		multiErr = multierror.Append(multiErr, err)
+	}
+
+	return multiErr.ErrorOrNil()
+}
+
+// expectedAttachments derives, from AppInfo4/AppInfo6/ZtunnelInfo, which attachments
+// should currently exist. AppInfo/ZtunnelInfo survive a restart (they're in a pinned
+// map), so they're the source of truth for what Reconcile needs to restore —
+// independent of whether the previous attachment was done via TCX or the legacy
+// netlink path. Host-side attachments (workload inbound/outbound, ztunnel host ingress)
+// are returned keyed by ifindex in hostExpected; ztunnel_ingress, which lives inside
+// ztunnel's own namespace, is returned separately as peerExpected plus the namespace
+// name it belongs to, since ifindex numbers aren't comparable across namespaces.
+func (r *RedirectServer) expectedAttachments() (hostExpected map[uint32][]expectedAttachment, peerNs string, peerExpected map[uint32][]expectedAttachment, err error) {
+	hostExpected = map[uint32][]expectedAttachment{}
+	addWorkload := func(ifindex uint32) {
+		hostExpected[ifindex] = append(hostExpected[ifindex],
+			expectedAttachment{EgressDir, r.obj.AppInbound, r.inboundFd, r.inboundProgName},
+			expectedAttachment{IngressDir, r.obj.AppOutbound, r.outboundFd, r.outboundProgName})
+	}
+
+	multiErr := istiomultierror.New()
+
+	var key4 [4]byte
+	var info mapInfo
+	iter4 := r.obj.AppInfo4.Iterate()
+	for iter4.Next(&key4, &info) {
+		addWorkload(info.Ifindex)
+	}
+	if err := iter4.Err(); err != nil {
+		multiErr = multierror.Append(multiErr, fmt.Errorf("failed to iterate AppInfo4: %w", err))
+	}
+
+	var key6 [16]byte
+	iter6 := r.obj.AppInfo6.Iterate()
+	for iter6.Next(&key6, &info) {
+		addWorkload(info.Ifindex)
+	}
+	if err := iter6.Err(); err != nil {
+		multiErr = multierror.Append(multiErr, fmt.Errorf("failed to iterate AppInfo6: %w", err))
+	}
+
+	var zt mapInfo
+	if lookupErr := r.obj.ZtunnelInfo.Lookup(uint32(0), &zt); lookupErr == nil && zt.Ifindex != 0 {
+		hostExpected[zt.Ifindex] = append(hostExpected[zt.Ifindex], expectedAttachment{
+			IngressDir, r.obj.ZtunnelHostIngress, r.ztunnelHostingressFd, r.ztunnelHostingressProgName,
+		})
+		if zt.PeerIndex != 0 {
+			peerNs = string(bytes.TrimRight(zt.PeerNs[:], "\x00"))
+			peerExpected = map[uint32][]expectedAttachment{
+				zt.PeerIndex: {{IngressDir, r.obj.ZtunnelIngress, r.ztunnelIngressFd, r.ztunnelIngressProgName}},
+			}
+		}
+	}
+
+	return hostExpected, peerNs, peerExpected, multiErr.ErrorOrNil()
+}
+
+// reconcileNetNS reconciles TC attachment for every interface in the current network
+// namespace (the host namespace when nsPath is empty): existing attachments are
+// repaired via reconcileFilters, and ifindexes with an expectedAttachment but no
+// attachment at all (TCX or legacy) are (re)created via reconcileExpected.
+func (r *RedirectServer) reconcileNetNS(nsPath string, expected map[uint32][]expectedAttachment) error {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return fmt.Errorf("failed to list interfaces: %w", err)
+	}
+
+	multiErr := istiomultierror.New()
+	known := r.knownProgFds()
+	for _, iface := range ifaces {
+		ifindex := uint32(iface.Index)
+		for _, dir := range []TCFilterDir{IngressDir, EgressDir} {
+			if err := r.reconcileFilters(ifindex, dir, known); err != nil {
+				multiErr = multierror.Append(multiErr, fmt.Errorf("ifindex %d (netns %q): %w", ifindex, nsPath, err))
+			}
+		}
+		for _, att := range expected[ifindex] {
+			if err := r.reconcileExpected(ifindex, att); err != nil {
+				multiErr = multierror.Append(multiErr, fmt.Errorf("ifindex %d (netns %q): %w", ifindex, nsPath, err))
+			}
+		}
+	}
+	return multiErr.ErrorOrNil()
+}
+
+// reconcileExpected attaches att on ifindex if neither a TCX bpf_link pin nor a legacy
+// netlink filter named att.name is already present. This is the path that notices an
+// attachment missing entirely — something reconcileFilters, which only ever inspects
+// netlink filters, can never see for a TCX link: no qdisc or cls_bpf filter is created
+// for link.AttachTCX, so a TCX attachment that never landed (or whose pin was removed
+// out of band) is otherwise silently missed on every restart.
+func (r *RedirectServer) reconcileExpected(ifindex uint32, att expectedAttachment) error {
+	if _, err := os.Stat(filepath.Join(tcxPinDir(ifindex, att.dir), att.name)); err == nil {
+		return nil // already linked via TCX
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to stat TCX link pin for %s: %w", att.name, err)
+	}
+
+	filters, err := r.getTCFilters(ifindex, att.dir)
+	if err != nil {
+		return fmt.Errorf("failed to list %s filters: %w", att.dir, err)
+	}
+	for _, f := range filters {
+		if f.Attribute.Kind == "bpf" && f.Attribute.BPF != nil &&
+			f.Attribute.BPF.Name != nil && *f.Attribute.BPF.Name == att.name {
+			return nil // already attached via the legacy netlink path
+		}
+	}
+
+	log.Infof("re-attaching missing %s attachment for program %q on ifindex %d", att.dir, att.name, ifindex)
+	return r.attachProg(ifindex, att.dir, att.prog, att.fd, att.name)
+}
+
+// knownProgFds maps the name of every program this run just loaded to its current FD,
+// so reconcileFilters can tell a stale-FD filter for one of our own programs apart from
+// a filter left behind by a now-obsolete build of ambient_redirect.bpf.c.
+func (r *RedirectServer) knownProgFds() map[string]uint32 {
+	return map[string]uint32{
+		r.ztunnelHostingressProgName: r.ztunnelHostingressFd,
+		r.ztunnelIngressProgName:     r.ztunnelIngressFd,
+		r.inboundProgName:            r.inboundFd,
+		r.outboundProgName:           r.outboundFd,
+	}
+}
+
+// reconcileFilters inspects the TC filters attached in dir on ifindex: a filter naming
+// one of our programs but carrying a stale FD is re-attached against the freshly loaded
+// FD, and a filter naming a program we no longer recognize is removed outright.
+func (r *RedirectServer) reconcileFilters(ifindex uint32, dir TCFilterDir, known map[string]uint32) error {
+	objs, err := r.getTCFilters(ifindex, dir)
+	if err != nil {
+		return fmt.Errorf("failed to list %s filters: %w", dir, err)
+	}
+
+	multiErr := istiomultierror.New()
+	for _, obj := range objs {
+		if obj.Attribute.Kind != "bpf" || obj.Attribute.BPF == nil || obj.Attribute.BPF.Name == nil {
+			continue
+		}
+		name := *obj.Attribute.BPF.Name
+		fd, ok := known[name]
+		if !ok {
+			log.Infof("removing TC %s filter for obsolete program %q on ifindex %d", dir, name, ifindex)
+			if err := r.detachTC(ifindex, dir, name); err != nil {
+				multiErr = multierror.Append(multiErr, err)
+			}
+			continue
+		}
+		if obj.Attribute.BPF.FD != nil && *obj.Attribute.BPF.FD == fd {
+			continue
+		}
+		log.Infof("re-attaching TC %s filter for program %q on ifindex %d after restart", dir, name, ifindex)
+		if err := r.detachTC(ifindex, dir, name); err != nil {
+			multiErr = multierror.Append(multiErr, err)
+			continue
+		}
+		if err := r.attachTC(ifindex, dir, fd, name); err != nil {
+			multiErr = multierror.Append(multiErr, err)
+		}
+	}
+	return multiErr.ErrorOrNil()
+}
+
+// pruneStaleAppInfo removes AppInfo4/AppInfo6/ZtunnelInfo entries whose ifindex no
+// longer corresponds to a live host interface, which otherwise accumulate across pod
+// churn that happened while the agent was down.
+func (r *RedirectServer) pruneStaleAppInfo() error {
+	multiErr := istiomultierror.New()
+
+	var key4 [4]byte
+	var info mapInfo
+	var stale4 [][4]byte
+	iter4 := r.obj.AppInfo4.Iterate()
+	for iter4.Next(&key4, &info) {
+		if !ifindexExists(info.Ifindex) {
+			stale4 = append(stale4, key4)
+		}
+	}
+	if err := iter4.Err(); err != nil {
+		multiErr = multierror.Append(multiErr, fmt.Errorf("failed to iterate AppInfo4: %w", err))
+	}
+	for _, k := range stale4 {
+		if err := r.obj.AppInfo4.Delete(k); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			multiErr = multierror.Append(multiErr, err)
+		}
+	}
+
+	var key6 [16]byte
+	var stale6 [][16]byte
+	iter6 := r.obj.AppInfo6.Iterate()
+	for iter6.Next(&key6, &info) {
+		if !ifindexExists(info.Ifindex) {
+			stale6 = append(stale6, key6)
+		}
+	}
+	if err := iter6.Err(); err != nil {
+		multiErr = multierror.Append(multiErr, fmt.Errorf("failed to iterate AppInfo6: %w", err))
+	}
+	for _, k := range stale6 {
+		if err := r.obj.AppInfo6.Delete(k); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			multiErr = multierror.Append(multiErr, err)
+		}
+	}
+
+	var zt mapInfo
+	if err := r.obj.ZtunnelInfo.Lookup(uint32(0), &zt); err == nil && zt.Ifindex != 0 && !ifindexExists(zt.Ifindex) {
+		if err := r.obj.ZtunnelInfo.Update(uint32(0), mapInfo{}, ebpf.UpdateAny); err != nil {
+			multiErr = multierror.Append(multiErr, err)
+		}
+	}
+
+	return multiErr.ErrorOrNil()
+}
+
+func ifindexExists(ifindex uint32) bool {
+	_, err := net.InterfaceByIndex(int(ifindex))
+	return err == nil
+}
@@ -0,0 +1,44 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestKnownProgFds(t *testing.T) {
+	r := &RedirectServer{
+		ztunnelHostingressProgName: "ztunnel_host_ingress",
+		ztunnelHostingressFd:       1,
+		ztunnelIngressProgName:     "ztunnel_ingress",
+		ztunnelIngressFd:           2,
+		inboundProgName:            "app_inbound",
+		inboundFd:                  3,
+		outboundProgName:           "app_outbound",
+		outboundFd:                 4,
+	}
+
+	want := map[string]uint32{
+		"ztunnel_host_ingress": 1,
+		"ztunnel_ingress":      2,
+		"app_inbound":          3,
+		"app_outbound":         4,
+	}
+
+	if got := r.knownProgFds(); !reflect.DeepEqual(got, want) {
+		t.Errorf("knownProgFds() = %v, want %v", got, want)
+	}
+}
@@ -33,11 +33,13 @@ package server
 import (
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/netip"
 	"os"
 
 	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/features"
 	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/florianl/go-tc"
 	"github.com/florianl/go-tc/core"
@@ -57,9 +59,19 @@ const (
 	MapsPinpath         = "/sys/fs/bpf/ambient"
 	CaptureDNSFlag      = uint8(1 << 0)
 
+	// ProgsPinpath is where the ambient_redirect BPF programs are pinned, in addition to
+	// their maps, so that their FDs survive a ztunnel-cni restart and can be re-linked
+	// via bpf_obj_get instead of being reloaded from scratch.
+	ProgsPinpath = "/sys/fs/bpf/ambient/progs"
+
 	QdiscKind            = "clsact"
 	TcaBpfFlagActDiretct = uint32(1 << 0) // refer to include/uapi/linux/pkt_cls.h TCA_BPF_FLAG_ACT_DIRECT
 	TcPrioFilter         = 1              // refer to include/uapi/linux/pkt_sched.h TC_PRIO_FILLER
+
+	// MaxHostIPsPerFamily bounds how many host IPs of a given address family can be
+	// programmed at once. The node's IPv4 and/or IPv6 addresses rarely change, but we
+	// keep a small amount of headroom for multi-homed nodes.
+	MaxHostIPsPerFamily = 16
 )
 
 const (
@@ -88,6 +100,14 @@ type RedirectServer struct {
 	inboundProgName            string
 	outboundFd                 uint32
 	outboundProgName           string
+
+	// eventReader fans datapath redirect_event records out to Metrics and, if set,
+	// eventsJSONL. It is nil until StartEventConsumer is called.
+	eventReader eventReader
+	// Metrics is the Prometheus registry populated by StartEventConsumer.
+	Metrics *EventMetrics
+	// eventsJSONL, if non-nil, receives one JSON line per redirect_event for debugging.
+	eventsJSONL io.Writer
 }
 
 var stringToLevel = map[string]uint32{
@@ -102,25 +122,62 @@ func (r *RedirectServer) SetLogLevel(level string) {
 	}
 }
 
+// UpdateHostIP replaces the full set of host IPs the datapath matches against. Both
+// host_ip_info4 and host_ip_info6 are fixed-size BPF_MAP_TYPE_ARRAY maps that the
+// datapath scans in full on every packet, so a slot left over from a previous call with
+// more addresses of that family would otherwise keep matching traffic against a stale
+// IP; every slot is zeroed first so a shorter ips list actually shrinks what matches.
 func (r *RedirectServer) UpdateHostIP(ips []string) error {
-	if len(ips) > 2 {
-		return fmt.Errorf("too may ips inputed: %d", len(ips))
+	v4, v6, err := splitHostIPsByFamily(ips)
+	if err != nil {
+		return err
 	}
+
+	for i := uint32(0); i < MaxHostIPsPerFamily; i++ {
+		if err := r.obj.HostIpInfo4.Update(i, [4]byte{}, ebpf.UpdateAny); err != nil {
+			return fmt.Errorf("failed to clear ipv4 host ip slot %d: %w", i, err)
+		}
+		if err := r.obj.HostIpInfo6.Update(i, [16]byte{}, ebpf.UpdateAny); err != nil {
+			return fmt.Errorf("failed to clear ipv6 host ip slot %d: %w", i, err)
+		}
+	}
+
+	for i, ip := range v4 {
+		if err := r.obj.HostIpInfo4.Update(uint32(i), ip.As4(), ebpf.UpdateAny); err != nil {
+			return err
+		}
+	}
+	for i, ip := range v6 {
+		if err := r.obj.HostIpInfo6.Update(uint32(i), ip.As16(), ebpf.UpdateAny); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitHostIPsByFamily parses ips and splits them by address family, erroring if either
+// family has more addresses than MaxHostIPsPerFamily slots to hold them. It is split out
+// of UpdateHostIP so this parsing/bounds-checking logic can be unit tested without a
+// live BPF map.
+func splitHostIPsByFamily(ips []string) (v4, v6 []netip.Addr, err error) {
 	for _, v := range ips {
 		ip, err := netip.ParseAddr(v)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
 		if ip.Is4() {
-			err = r.obj.HostIpInfo.Update(uint32(0), ip.As16(), ebpf.UpdateAny)
+			v4 = append(v4, ip)
 		} else {
-			err = r.obj.HostIpInfo.Update(uint32(1), ip.As16(), ebpf.UpdateAny)
-		}
-		if err != nil {
-			return err
+			v6 = append(v6, ip)
 		}
 	}
-	return nil
+	if len(v4) > MaxHostIPsPerFamily {
+		return nil, nil, fmt.Errorf("too many ipv4 host ips inputed, max %d supported", MaxHostIPsPerFamily)
+	}
+	if len(v6) > MaxHostIPsPerFamily {
+		return nil, nil, fmt.Errorf("too many ipv6 host ips inputed, max %d supported", MaxHostIPsPerFamily)
+	}
+	return v4, v6, nil
 }
 
 func AddPodToMesh(ifIndex uint32, macAddr net.HardwareAddr, ips []netip.Addr) error {
@@ -156,15 +213,14 @@ func AddPodToMesh(ifIndex uint32, macAddr net.HardwareAddr, ips []netip.Addr) er
 	if len(ips) == 0 {
 		return fmt.Errorf("nil ips inputed")
 	}
-	// TODO: support multiple IPs and IPv6
-	ipAddr := ips[0]
-	// ip slice is just in network endian
-	ip := ipAddr.AsSlice()
-	if len(ip) != 4 {
-		return fmt.Errorf("invalid ip addr(%s), ipv4 is supported", ipAddr.String())
-	}
-	if err := r.obj.AppInfo.Update(ip, mapInfo, ebpf.UpdateAny); err != nil {
+
+	added, err := r.updateAppInfo(ips, mapInfo)
+	if err != nil {
 		multiErr = multierror.Append(multiErr, err)
+		// roll back any addresses that were already programmed, then tear down TC
+		if err := r.deleteAppInfo(added); err != nil {
+			multiErr = multierror.Append(multiErr, err)
+		}
 		if err := r.detachTCForWorkload(ifIndex); err != nil {
 			multiErr = multierror.Append(multiErr, err)
 		}
@@ -173,6 +229,45 @@ func AddPodToMesh(ifIndex uint32, macAddr net.HardwareAddr, ips []netip.Addr) er
 	return multiErr.ErrorOrNil()
 }
 
+// updateAppInfo programs mapInfo for every address in ips, split across the IPv4 and
+// IPv6 AppInfo maps. It returns the subset of ips that were successfully programmed so
+// that a caller can roll them back atomically if a later address fails.
+func (r *RedirectServer) updateAppInfo(ips []netip.Addr, info mapInfo) ([]netip.Addr, error) {
+	added := make([]netip.Addr, 0, len(ips))
+	for _, ipAddr := range ips {
+		if ipAddr.Is4() {
+			if err := r.obj.AppInfo4.Update(ipAddr.As4(), info, ebpf.UpdateAny); err != nil {
+				return added, fmt.Errorf("failed to update app info for %s: %w", ipAddr, err)
+			}
+		} else {
+			if err := r.obj.AppInfo6.Update(ipAddr.As16(), info, ebpf.UpdateAny); err != nil {
+				return added, fmt.Errorf("failed to update app info for %s: %w", ipAddr, err)
+			}
+		}
+		added = append(added, ipAddr)
+	}
+	return added, nil
+}
+
+// deleteAppInfo removes every address in ips from the IPv4/IPv6 AppInfo maps it belongs
+// to, accumulating (rather than short-circuiting on) any errors so that removal is best
+// effort across the whole address set.
+func (r *RedirectServer) deleteAppInfo(ips []netip.Addr) error {
+	multiErr := istiomultierror.New()
+	for _, ipAddr := range ips {
+		var err error
+		if ipAddr.Is4() {
+			err = r.obj.AppInfo4.Delete(ipAddr.As4())
+		} else {
+			err = r.obj.AppInfo6.Delete(ipAddr.As16())
+		}
+		if err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			multiErr = multierror.Append(multiErr, err)
+		}
+	}
+	return multiErr.ErrorOrNil()
+}
+
 func (r *RedirectServer) initBpfObjects() error {
 	var options ebpf.CollectionOptions
 	if _, err := os.Stat(MapsPinpath); err != nil {
@@ -183,12 +278,37 @@ func (r *RedirectServer) initBpfObjects() error {
 		}
 	}
 	options.Maps.PinPath = MapsPinpath
-	// load ebpf program
+	if err := os.MkdirAll(ProgsPinpath, os.ModePerm); err != nil {
+		return fmt.Errorf("unable to create program pin directory: %v", err)
+	}
+	options.Programs.PinPath = ProgsPinpath
+
+	spec, err := loadAmbient_redirect()
+	if err != nil {
+		return fmt.Errorf("loading collection spec: %v", err)
+	}
+
+	// Mark every program for pinning by its ELF-derived name, the same way the maps
+	// above are pinned via options.Maps.PinPath: LoadAndAssign then reuses an existing
+	// pin instead of reloading, which is what lets a restarted agent recover the same
+	// FDs rather than tearing down and re-attaching everything.
+	for _, progSpec := range spec.Programs {
+		progSpec.Pinning = ebpf.PinByName
+	}
+
+	// BPF_MAP_TYPE_RINGBUF needs a 5.8+ kernel; ambient redirect events have no perf
+	// event array fallback, so fail fast instead of loading a collection whose
+	// `events` map the kernel can't create.
+	if features.HaveMapType(ebpf.RingBuf) != nil {
+		return fmt.Errorf("kernel does not support BPF_MAP_TYPE_RINGBUF, required for ambient redirect events")
+	}
+
 	obj := ambient_redirectObjects{}
-	if err := loadAmbient_redirectObjects(&obj, &options); err != nil {
+	if err := spec.LoadAndAssign(&obj, &options); err != nil {
 		return fmt.Errorf("loading objects: %v", err)
 	}
 	r.obj = obj
+
 	r.ztunnelHostingressFd = uint32(r.obj.ZtunnelHostIngress.FD())
 	ztunnelHostingressInfo, err := r.obj.ZtunnelHostIngress.Info()
 	if err != nil {
@@ -214,9 +334,14 @@ func (r *RedirectServer) initBpfObjects() error {
 		return fmt.Errorf("unable to load metadata of bfp prog: %v", err)
 	}
 	r.outboundProgName = outboundInfo.Name
+
 	return nil
 }
 
+// maxPeerNsLen bounds mapInfo.PeerNs; network namespace names under /var/run/netns are
+// short (CNI-generated UUIDs or interface names), so this leaves generous headroom.
+const maxPeerNsLen = 64
+
 // Note: this struct should be exactly the same defined in C
 // it will be encoded byte by byte into memory
 type mapInfo struct {
@@ -224,6 +349,12 @@ type mapInfo struct {
 	MacAddr [6]byte
 	Flag    uint8
 	Pad     uint8
+	// PeerIndex and PeerNs locate the matching veth end inside the peer namespace; only
+	// meaningful for the ZtunnelInfo singleton (app_info4/6 entries leave them zeroed),
+	// where they let Reconcile find and repair the ztunnel_ingress TCX attachment that
+	// attachTCForZtunnel makes inside the ztunnel's own namespace rather than the host's.
+	PeerIndex uint32
+	PeerNs    [maxPeerNsLen]byte
 }
 
 func NewRedirectServer() *RedirectServer {
@@ -284,6 +415,11 @@ func setLimit() error {
 
 func (r *RedirectServer) Start(stop <-chan struct{}) {
 	log.Infof("Starting redirection Server")
+
+	if err := r.StartEventConsumer(); err != nil {
+		log.Errorf("failed to start ambient redirect event consumer: %v", err)
+	}
+
 	go func() {
 		for {
 			select {
@@ -293,6 +429,11 @@ func (r *RedirectServer) Start(stop <-chan struct{}) {
 				}
 
 			case <-stop:
+				if r.eventReader != nil {
+					if err := r.eventReader.Close(); err != nil {
+						log.Warnf("failed to close ambient redirect event reader: %v", err)
+					}
+				}
 				r.obj.Close()
 				return
 			}
@@ -337,6 +478,9 @@ func (r *RedirectServer) handleRequest(args *RedirectArgs) error {
 			if namespace == "" {
 				return fmt.Errorf("invalid namespace")
 			}
+			if len(namespace) >= maxPeerNsLen {
+				return fmt.Errorf("peer namespace name %q too long, max %d bytes", namespace, maxPeerNsLen-1)
+			}
 			if err := r.attachTCForZtunnel(ifindex, peerIndex, namespace); err != nil {
 				multiErr = multierror.Append(multiErr, err)
 				if err := r.detachTCForZtunnel(ifindex, peerIndex, namespace); err != nil {
@@ -347,6 +491,8 @@ func (r *RedirectServer) handleRequest(args *RedirectArgs) error {
 			if args.CaptureDNS {
 				mapInfo.Flag |= CaptureDNSFlag
 			}
+			mapInfo.PeerIndex = peerIndex
+			copy(mapInfo.PeerNs[:], namespace)
 			if err := r.obj.ZtunnelInfo.Update(uint32(0), mapInfo, ebpf.UpdateAny); err != nil {
 				multiErr = multierror.Append(multiErr, err)
 				if err := r.detachTCForZtunnel(ifindex, peerIndex, namespace); err != nil {
@@ -358,13 +504,6 @@ func (r *RedirectServer) handleRequest(args *RedirectArgs) error {
 		if len(ipAddrs) == 0 {
 			return fmt.Errorf("nil ipAddrs inputed")
 		}
-		// TODO: support multiple IPs and IPv6
-		ipAddr := ipAddrs[0]
-		// ip slice is just in network endian
-		ip := ipAddr.AsSlice()
-		if len(ip) != 4 {
-			return fmt.Errorf("invalid ip addr(%s), ipv4 is supported", ipAddr.String())
-		}
 		if remove {
 			if ifindex != 0 {
 				if err := r.detachTCForWorkload(ifindex); err != nil {
@@ -373,7 +512,8 @@ func (r *RedirectServer) handleRequest(args *RedirectArgs) error {
 			} else {
 				log.Debugf("zero ifindex for app removal")
 			}
-			if err := r.obj.AppInfo.Delete(ip); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			// tear down every address of the pod atomically, regardless of family
+			if err := r.deleteAppInfo(ipAddrs); err != nil {
 				multiErr = multierror.Append(multiErr, err)
 			}
 		} else {
@@ -384,8 +524,12 @@ func (r *RedirectServer) handleRequest(args *RedirectArgs) error {
 				}
 				return multiErr.ErrorOrNil()
 			}
-			if err := r.obj.AppInfo.Update(ip, mapInfo, ebpf.UpdateAny); err != nil {
+			added, err := r.updateAppInfo(ipAddrs, mapInfo)
+			if err != nil {
 				multiErr = multierror.Append(multiErr, err)
+				if err := r.deleteAppInfo(added); err != nil {
+					multiErr = multierror.Append(multiErr, err)
+				}
 				if err := r.detachTCForWorkload(ifindex); err != nil {
 					multiErr = multierror.Append(multiErr, err)
 				}
@@ -401,12 +545,12 @@ func (r *RedirectServer) AcceptRequest(redirectArgs *RedirectArgs) {
 
 func (r *RedirectServer) attachTCForZtunnel(ifindex, peerIndex uint32, namespace string) error {
 	// attach to ztunnel host veth's ingress
-	if err := r.attachTC(ifindex, IngressDir, r.ztunnelHostingressFd, r.ztunnelHostingressProgName); err != nil {
+	if err := r.attachProg(ifindex, IngressDir, r.obj.ZtunnelHostIngress, r.ztunnelHostingressFd, r.ztunnelHostingressProgName); err != nil {
 		return err
 	}
 	// attach to ztunnel veth's ingress in POD namespace
 	if err := ns.WithNetNSPath(fmt.Sprintf("/var/run/netns/%s", namespace), func(ns.NetNS) error {
-		if err := r.attachTC(peerIndex, IngressDir, r.ztunnelIngressFd, r.ztunnelIngressProgName); err != nil {
+		if err := r.attachProg(peerIndex, IngressDir, r.obj.ZtunnelIngress, r.ztunnelIngressFd, r.ztunnelIngressProgName); err != nil {
 			return err
 		}
 		return nil
@@ -417,19 +561,15 @@ func (r *RedirectServer) attachTCForZtunnel(ifindex, peerIndex uint32, namespace
 }
 
 func (r *RedirectServer) detachTCForZtunnel(ifindex, peerIndex uint32, namespace string) error {
-	if err := r.detachTC(ifindex, IngressDir, r.ztunnelHostingressProgName); err != nil {
+	if err := r.detachProg(ifindex, IngressDir, r.ztunnelHostingressProgName); err != nil {
 		return fmt.Errorf("failed to detach TC ingress for ztunnel %d: %v", ifindex, err)
 	}
 
-	if err := r.delQdiscIfNeeded(ifindex); err != nil {
-		return err
-	}
-
 	if err := ns.WithNetNSPath(fmt.Sprintf("/var/run/netns/%s", namespace), func(ns.NetNS) error {
-		if err := r.detachTC(peerIndex, IngressDir, r.ztunnelIngressProgName); err != nil {
+		if err := r.detachProg(peerIndex, IngressDir, r.ztunnelIngressProgName); err != nil {
 			return fmt.Errorf("failed to detach TC ingress for ztunnel %d(in pod ns): %v", peerIndex, err)
 		}
-		return r.delQdiscIfNeeded(peerIndex)
+		return nil
 	}); err != nil {
 		return err
 	}
@@ -437,23 +577,23 @@ func (r *RedirectServer) detachTCForZtunnel(ifindex, peerIndex uint32, namespace
 }
 
 func (r *RedirectServer) detachTCForWorkload(ifindex uint32) error {
-	if err := r.detachTC(ifindex, IngressDir, r.outboundProgName); err != nil {
+	if err := r.detachProg(ifindex, IngressDir, r.outboundProgName); err != nil {
 		return fmt.Errorf("failed to detach TC ingress for IfIndex %d: %v", ifindex, err)
 	}
-	if err := r.detachTC(ifindex, EgressDir, r.inboundProgName); err != nil {
+	if err := r.detachProg(ifindex, EgressDir, r.inboundProgName); err != nil {
 		return fmt.Errorf("failed to detach TC egress for IfIndex %d: %v", ifindex, err)
 	}
 
-	return r.delQdiscIfNeeded(ifindex)
+	return nil
 }
 
 func (r *RedirectServer) attachTCForWorkLoad(ifindex uint32) error {
 	// attach to workload host veth's egress
-	if err := r.attachTC(ifindex, EgressDir, r.inboundFd, r.inboundProgName); err != nil {
+	if err := r.attachProg(ifindex, EgressDir, r.obj.AppInbound, r.inboundFd, r.inboundProgName); err != nil {
 		return err
 	}
 	// attach to workload host veth's ingress
-	if err := r.attachTC(ifindex, IngressDir, r.outboundFd, r.outboundProgName); err != nil {
+	if err := r.attachProg(ifindex, IngressDir, r.obj.AppOutbound, r.outboundFd, r.outboundProgName); err != nil {
 		return err
 	}
 	return nil
@@ -582,6 +722,8 @@ func (r *RedirectServer) detachTC(ifindex uint32, direction TCFilterDir, name st
 	return nil
 }
 
+// delQdiscIfNeeded removes the clsact qdisc once no cls_bpf filters reference it. It is
+// only ever called from the legacy netlink attach path; TCX bpf_links don't own a qdisc.
 func (r *RedirectServer) delQdiscIfNeeded(ifindex uint32) error {
 	objs, err := r.getTCFilters(ifindex, IngressDir)
 	if err != nil {
@@ -648,12 +790,27 @@ func (r *RedirectServer) dumpZtunnelInfo() (*mapInfo, error) {
 }
 
 //nolint:unused
-func (r *RedirectServer) dumpAppInfo() ([]uint32, []mapInfo) {
-	var keyOut uint32
+func (r *RedirectServer) dumpAppInfo4() ([][4]byte, []mapInfo) {
+	var keyOut [4]byte
+	var valueOut mapInfo
+	var values []mapInfo
+	var keys [][4]byte
+	mapIter := r.obj.AppInfo4.Iterate()
+	for mapIter.Next(&keyOut, &valueOut) {
+		keys = append(keys, keyOut)
+		values = append(values, valueOut)
+
+	}
+	return keys, values
+}
+
+//nolint:unused
+func (r *RedirectServer) dumpAppInfo6() ([][16]byte, []mapInfo) {
+	var keyOut [16]byte
 	var valueOut mapInfo
 	var values []mapInfo
-	var keys []uint32
-	mapIter := r.obj.AppInfo.Iterate()
+	var keys [][16]byte
+	mapIter := r.obj.AppInfo6.Iterate()
 	for mapIter.Next(&keyOut, &valueOut) {
 		keys = append(keys, keyOut)
 		values = append(values, valueOut)
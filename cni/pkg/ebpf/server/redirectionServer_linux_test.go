@@ -0,0 +1,94 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitHostIPsByFamily(t *testing.T) {
+	cases := []struct {
+		name    string
+		ips     []string
+		wantV4  []string
+		wantV6  []string
+		wantErr string
+	}{
+		{
+			name:   "mixed families",
+			ips:    []string{"10.0.0.1", "fd00::1", "10.0.0.2"},
+			wantV4: []string{"10.0.0.1", "10.0.0.2"},
+			wantV6: []string{"fd00::1"},
+		},
+		{
+			name:    "invalid address",
+			ips:     []string{"not-an-ip"},
+			wantErr: "ParseAddr",
+		},
+		{
+			name:    "too many ipv4",
+			ips:     ipv4Range(MaxHostIPsPerFamily + 1),
+			wantErr: "too many ipv4 host ips",
+		},
+		{
+			name:   "exactly the limit",
+			ips:    ipv4Range(MaxHostIPsPerFamily),
+			wantV4: ipv4Range(MaxHostIPsPerFamily),
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			v4, v6, err := splitHostIPsByFamily(tc.ips)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("splitHostIPsByFamily(%v) error = %v, want containing %q", tc.ips, err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("splitHostIPsByFamily(%v) unexpected error: %v", tc.ips, err)
+			}
+			if tc.wantV4 != nil && !reflect.DeepEqual(addrStrings(v4), tc.wantV4) {
+				t.Errorf("v4 = %v, want %v", addrStrings(v4), tc.wantV4)
+			}
+			if tc.wantV6 != nil && !reflect.DeepEqual(addrStrings(v6), tc.wantV6) {
+				t.Errorf("v6 = %v, want %v", addrStrings(v6), tc.wantV6)
+			}
+		})
+	}
+}
+
+// ipv4Range returns n distinct IPv4 addresses, used to exercise the MaxHostIPsPerFamily
+// bound without hardcoding a list that size.
+func ipv4Range(n int) []string {
+	ips := make([]string, n)
+	for i := range ips {
+		ips[i] = fmt.Sprintf("10.0.%d.%d", (i+1)/256, (i+1)%256)
+	}
+	return ips
+}
+
+func addrStrings(addrs []netip.Addr) []string {
+	out := make([]string, len(addrs))
+	for i, a := range addrs {
+		out[i] = a.String()
+	}
+	return out
+}
@@ -0,0 +1,145 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/cilium/ebpf/ringbuf"
+	"golang.org/x/sys/unix"
+)
+
+// RedirectEvent mirrors `struct redirect_event` in ambient_redirect.bpf.c byte for
+// byte; it is decoded directly off the ring buffer the datapath writes into for every
+// packet a tc program makes a verdict on.
+type RedirectEvent struct {
+	TimestampNs uint64
+	NsCookie    uint64
+	ProgID      uint32
+	Ifindex     uint32
+	SAddr       [16]byte
+	DAddr       [16]byte
+	Sport       uint16
+	Dport       uint16
+	Family      uint8
+	Verdict     uint8
+	IsDNS       uint8
+	Pad         uint8
+}
+
+// eventReader wraps ringbuf.Reader so consumeEvents doesn't need to know about the
+// underlying ebpf.Map; RedirectServer.eventReader is typed as an interface only so
+// Start's shutdown path can Close it without importing ringbuf there too.
+type eventReader interface {
+	ReadRaw() ([]byte, error)
+	Close() error
+}
+
+type ringbufEventReader struct{ r *ringbuf.Reader }
+
+func (a *ringbufEventReader) ReadRaw() ([]byte, error) {
+	rec, err := a.r.Read()
+	if err != nil {
+		return nil, err
+	}
+	return rec.RawSample, nil
+}
+
+func (a *ringbufEventReader) Close() error { return a.r.Close() }
+
+// StartEventConsumer opens the ambient redirect ring buffer, populates
+// RedirectServer.Metrics, and starts a goroutine that decodes every RedirectEvent,
+// records it to Metrics, and — if SetEventJSONLWriter was called — appends it as a
+// JSON line. The goroutine exits cleanly once Start's select loop closes eventReader on
+// stop.
+func (r *RedirectServer) StartEventConsumer() error {
+	rd, err := ringbuf.NewReader(r.obj.Events)
+	if err != nil {
+		return fmt.Errorf("failed to open ambient redirect ring buffer: %w", err)
+	}
+	reader := &ringbufEventReader{r: rd}
+
+	r.eventReader = reader
+	r.Metrics = newEventMetrics()
+
+	go r.consumeEvents(reader)
+	return nil
+}
+
+// SetEventJSONLWriter enables a debug JSONL stream of every RedirectEvent. It must be
+// called before Start.
+func (r *RedirectServer) SetEventJSONLWriter(w io.Writer) {
+	r.eventsJSONL = w
+}
+
+func (r *RedirectServer) consumeEvents(reader eventReader) {
+	for {
+		raw, err := reader.ReadRaw()
+		if err != nil {
+			if errors.Is(err, ringbuf.ErrClosed) {
+				return
+			}
+			log.Errorf("failed to read ambient redirect event: %v", err)
+			continue
+		}
+
+		var evt RedirectEvent
+		if err := binary.Read(bytes.NewReader(raw), binary.LittleEndian, &evt); err != nil {
+			log.Errorf("failed to decode ambient redirect event: %v", err)
+			continue
+		}
+
+		r.recordEvent(&evt)
+	}
+}
+
+func (r *RedirectServer) recordEvent(evt *RedirectEvent) {
+	prog := progIDLabel(evt.ProgID)
+	verdict := verdictLabel(evt.Verdict)
+	r.Metrics.PacketsTotal.WithLabelValues(prog, verdict).Inc()
+
+	if evt.IsDNS == 1 {
+		if now, err := monotonicNowNs(); err == nil && now > evt.TimestampNs {
+			r.Metrics.DNSCaptureLatency.Observe(time.Duration(now - evt.TimestampNs).Seconds())
+		}
+	}
+
+	if r.eventsJSONL != nil {
+		line, err := json.Marshal(evt)
+		if err != nil {
+			log.Errorf("failed to marshal ambient redirect event: %v", err)
+			return
+		}
+		if _, err := r.eventsJSONL.Write(append(line, '\n')); err != nil {
+			log.Errorf("failed to write ambient redirect event to JSONL stream: %v", err)
+		}
+	}
+}
+
+// monotonicNowNs reads CLOCK_MONOTONIC, the same clock bpf_ktime_get_ns() uses, so it
+// can be diffed directly against RedirectEvent.TimestampNs.
+func monotonicNowNs() (uint64, error) {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		return 0, err
+	}
+	return uint64(ts.Sec)*1e9 + uint64(ts.Nsec), nil
+}
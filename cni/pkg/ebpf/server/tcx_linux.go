@@ -0,0 +1,177 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/link"
+)
+
+// tcxLinksDir is where TCX bpf_links are pinned, one file per ifindex/direction, so
+// detachProg can tear them down with a pin-file unlink instead of a filter-name search.
+const tcxLinksDir = "links"
+
+var (
+	tcxOnce      sync.Once
+	tcxAvailable bool
+)
+
+// tcxSupported reports whether the running kernel understands BPF_LINK_TYPE_TCX
+// (Linux >= 6.6). The result is probed once per process and cached, since probing
+// attaches and immediately detaches a throwaway program against loopback.
+func tcxSupported() bool {
+	tcxOnce.Do(func() {
+		tcxAvailable = probeTCXSupport()
+	})
+	return tcxAvailable
+}
+
+func probeTCXSupport() bool {
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		return false
+	}
+
+	prog, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+		Type:    ebpf.SchedCLS,
+		License: "GPL",
+		Instructions: asm.Instructions{
+			asm.Mov.Imm(asm.R0, 0),
+			asm.Return(),
+		},
+	})
+	if err != nil {
+		return false
+	}
+	defer prog.Close()
+
+	l, err := link.AttachTCX(link.TCXOptions{
+		Program:   prog,
+		Attach:    ebpf.AttachTCXIngress,
+		Interface: lo.Index,
+	})
+	if err != nil {
+		return false
+	}
+	_ = l.Close()
+	return true
+}
+
+// attachProg attaches prog to ifindex's dir, preferring a TCX bpf_link (kernel >= 6.6,
+// no shared qdisc, ordered multi-program attach) and falling back to the legacy clsact
+// qdisc + cls_bpf netlink path when TCX isn't available or the attach itself fails.
+func (r *RedirectServer) attachProg(ifindex uint32, dir TCFilterDir, prog *ebpf.Program, fd uint32, name string) error {
+	if tcxSupported() {
+		if err := attachTCX(ifindex, dir, prog, name); err != nil {
+			log.Warnf("TCX attach failed for %s on ifindex %d, falling back to netlink clsact: %v", name, ifindex, err)
+		} else {
+			return nil
+		}
+	}
+	return r.attachTC(ifindex, dir, fd, name)
+}
+
+// detachProg undoes attachProg: if a TCX link pin exists for ifindex/dir it is unlinked,
+// otherwise the legacy netlink filter is removed and the clsact qdisc is torn down once
+// it is no longer needed.
+func (r *RedirectServer) detachProg(ifindex uint32, dir TCFilterDir, name string) error {
+	unlinked, err := detachTCX(ifindex, dir, name)
+	if err != nil {
+		return err
+	}
+	if unlinked {
+		return nil
+	}
+	if err := r.detachTC(ifindex, dir, name); err != nil {
+		return err
+	}
+	return r.delQdiscIfNeeded(ifindex)
+}
+
+func attachTCX(ifindex uint32, dir TCFilterDir, prog *ebpf.Program, name string) error {
+	attachType := ebpf.AttachTCXIngress
+	if dir == EgressDir {
+		attachType = ebpf.AttachTCXEgress
+	}
+
+	l, err := link.AttachTCX(link.TCXOptions{
+		Program:   prog,
+		Attach:    attachType,
+		Interface: int(ifindex),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to attach TCX %s link for %s on ifindex %d: %w", dir, name, ifindex, err)
+	}
+	// Pinning the link to bpffs keeps it alive independently of this process; the
+	// in-process handle is only needed long enough to create the pin.
+	defer func() {
+		if err := l.Close(); err != nil {
+			log.Warnf("failed to close in-process TCX link handle for %s: %v", name, err)
+		}
+	}()
+
+	dir2 := tcxPinDir(ifindex, dir)
+	if err := os.MkdirAll(dir2, os.ModePerm); err != nil {
+		return fmt.Errorf("unable to create TCX link pin directory %s: %v", dir2, err)
+	}
+	pinPath := filepath.Join(dir2, name)
+	if err := l.Pin(pinPath); err != nil {
+		return fmt.Errorf("failed to pin TCX link at %s: %w", pinPath, err)
+	}
+	return nil
+}
+
+// detachTCX unlinks the TCX bpf_link pinned for ifindex/dir under name, leaving any
+// other program's link in the same directory untouched — attachProg pins every program
+// under its own name precisely so two attachments sharing an (ifindex, dir), such as a
+// workload's inbound and outbound programs on the same interface in opposite
+// directions, can be detached independently. It returns ok=true when a pin for name
+// existed, so callers can tell "we handled this via TCX" apart from "fall through to
+// the legacy netlink path".
+func detachTCX(ifindex uint32, dir TCFilterDir, name string) (bool, error) {
+	pinDir := tcxPinDir(ifindex, dir)
+	pinPath := filepath.Join(pinDir, name)
+
+	l, err := link.LoadPinnedLink(pinPath, nil)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to load pinned TCX link %s: %w", pinPath, err)
+	}
+	if err := l.Unpin(); err != nil {
+		return true, fmt.Errorf("failed to unpin TCX link %s: %w", pinPath, err)
+	}
+	if err := l.Close(); err != nil {
+		log.Warnf("failed to close TCX link %s: %v", pinPath, err)
+	}
+
+	if err := os.Remove(pinDir); err != nil && !os.IsNotExist(err) {
+		log.Debugf("TCX link pin directory %s not removed (likely not empty): %v", pinDir, err)
+	}
+	return true, nil
+}
+
+func tcxPinDir(ifindex uint32, dir TCFilterDir) string {
+	return filepath.Join(MapsPinpath, tcxLinksDir, strconv.Itoa(int(ifindex)), string(dir))
+}